@@ -1,12 +1,19 @@
 package kube
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"sync"
 
 	kapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/util/retry"
 )
 
 // Annotator represents the exported methods for handling node annotations
@@ -15,248 +22,421 @@ type Annotator interface {
 	Set(key string, value interface{}) error
 	SetWithFailureHandler(key string, value interface{}, failFn FailureHandlerFn) error
 	Delete(key string)
+	SetLabels(key string, value interface{}) error
+	SetLabelsWithFailureHandler(key string, value interface{}, failFn FailureHandlerFn) error
+	DeleteLabel(key string)
 	Run() error
+	// Flush waits for changes enqueued by Run() to reach the apiserver. It is
+	// a no-op unless the annotator was constructed with WithBatcher, in which
+	// case Run() only enqueues and Flush is what actually waits on the write.
+	Flush(ctx context.Context) error
+	// Local applies the pending changes to a deep copy of obj and returns it,
+	// without contacting the apiserver. obj must be of the concrete type the
+	// annotator was constructed for (e.g. *v1.Node for a node annotator).
+	Local(obj runtime.Object) (runtime.Object, error)
+	// Diff returns the patch bytes that Run() would send to the apiserver.
+	Diff() ([]byte, error)
 }
 
 // FailureHandlerFn is a function called when adding an annotation fails
 type FailureHandlerFn func(obj interface{}, key string, val interface{})
 
-type action struct {
-	key     string
-	val     string
-	origVal interface{}
-	failFn  FailureHandlerFn
+// AnnotatorOption allows callers to tweak the patch produced by Run()
+type AnnotatorOption func(*patchOptions)
+
+type patchOptions struct {
+	patchType types.PatchType
+	batcher   *AnnotationBatcher
+	dryRun    bool
 }
 
-type nodeAnnotator struct {
-	kube     Interface
-	nodeName string
+// WithPatchType overrides the default JSON merge patch (types.MergePatchType)
+// used by Run(), both the Content-Type/patch-type argument sent to Patch()
+// and how the patch body itself is built: types.StrategicMergePatchType
+// switches the body to a strategic-merge patch computed against the current
+// object instead of a metadata-only JSON merge patch, for CRDs or types that
+// require it. When Run() goes through WithBatcher, the body is always the
+// metadata-only patch and only the patch-type argument follows this option.
+func WithPatchType(patchType types.PatchType) AnnotatorOption {
+	return func(o *patchOptions) {
+		o.patchType = patchType
+	}
+}
 
-	changes map[string]interface{}
-	sync.Mutex
+// WithBatcher routes Run() through the given AnnotationBatcher instead of
+// patching the apiserver synchronously. Callers that need to observe the
+// write landing should call Flush(ctx) afterward. Any failFn passed to
+// SetWithFailureHandler/SetLabelsWithFailureHandler only fires once the
+// batcher decides the write can never land (e.g. the object was deleted);
+// ordinary conflicts are retried silently with backoff and never reach it.
+func WithBatcher(b *AnnotationBatcher) AnnotatorOption {
+	return func(o *patchOptions) {
+		o.batcher = b
+	}
 }
 
-// NewNodeAnnotator returns a new annotator for Node objects
-func NewNodeAnnotator(kube Interface, nodeName string) Annotator {
-	return &nodeAnnotator{
-		kube:     kube,
-		nodeName: nodeName,
-		changes:  make(map[string]interface{}),
+// WithDryRun makes Run() a no-op against the apiserver, analogous to
+// `kubectl annotate --local`. Useful in unit tests and for callers that want
+// to compute the merged result (via Local/Diff) before committing it.
+func WithDryRun() AnnotatorOption {
+	return func(o *patchOptions) {
+		o.dryRun = true
 	}
 }
 
-func (na *nodeAnnotator) Set(key string, val interface{}) error {
-	return na.SetWithFailureHandler(key, val, nil)
+func newPatchOptions(opts ...AnnotatorOption) patchOptions {
+	o := patchOptions{patchType: types.MergePatchType}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
-func (na *nodeAnnotator) SetWithFailureHandler(key string, val interface{}, failFn FailureHandlerFn) error {
-	na.Lock()
-	defer na.Unlock()
+type action struct {
+	key     string
+	val     string
+	origVal interface{}
+	failFn  FailureHandlerFn
+}
 
-	if val == nil {
-		na.changes[key] = nil
-		return nil
+func newAction(key string, val interface{}, failFn FailureHandlerFn) (*action, error) {
+	act := &action{
+		key:     key,
+		origVal: val,
+		failFn:  failFn,
 	}
-
-	// Annotations must be either a valid string value or nil; coerce
-	// any non-empty values to string
-	if reflect.TypeOf(val).Kind() == reflect.String {
-		na.changes[key] = val.(string)
-	} else {
-		bytes, err := json.Marshal(val)
-		if err != nil {
-			return fmt.Errorf("failed to marshal %q value %v to string: %v", key, val, err)
+	if val != nil {
+		// Annotations must be either a valid string value or nil; coerce
+		// any non-empty values to string
+		if reflect.TypeOf(val).Kind() == reflect.String {
+			act.val = val.(string)
+		} else {
+			bytes, err := json.Marshal(val)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal %q value %v to string: %v", key, val, err)
+			}
+			act.val = string(bytes)
 		}
-		na.changes[key] = string(bytes)
 	}
-
-	return nil
+	return act, nil
 }
 
-func (na *nodeAnnotator) Delete(key string) {
-	na.Lock()
-	defer na.Unlock()
-	na.changes[key] = nil
+// metaPatch is the JSON body of a metadata-only merge patch. Values are
+// *string so that a nil entry marshals to JSON null, which instructs the
+// apiserver to remove the key rather than setting it to the empty string.
+type metaPatch struct {
+	Metadata struct {
+		Annotations map[string]*string `json:"annotations,omitempty"`
+		Labels      map[string]*string `json:"labels,omitempty"`
+	} `json:"metadata"`
 }
 
-func (na *nodeAnnotator) Run() error {
-	na.Lock()
-	defer na.Unlock()
-	if len(na.changes) == 0 {
-		return nil
+func buildMetaPatch(annotations, labels map[string]interface{}) ([]byte, error) {
+	patch := metaPatch{}
+	if len(annotations) > 0 {
+		patch.Metadata.Annotations = make(map[string]*string, len(annotations))
+		for k, v := range annotations {
+			if v == nil {
+				patch.Metadata.Annotations[k] = nil
+				continue
+			}
+			s := v.(string)
+			patch.Metadata.Annotations[k] = &s
+		}
 	}
+	if len(labels) > 0 {
+		patch.Metadata.Labels = make(map[string]*string, len(labels))
+		for k, v := range labels {
+			if v == nil {
+				patch.Metadata.Labels[k] = nil
+				continue
+			}
+			s := v.(string)
+			patch.Metadata.Labels[k] = &s
+		}
+	}
+	return json.Marshal(&patch)
+}
 
-	err := na.kube.SetAnnotationsOnNode(na.nodeName, na.changes)
-
-	// TODO(flaviof): need to resolve this conflict still
-	// if err != nil {
-	// 	// Let failure handlers clean up
-	// 	for _, act := range na.changes {
-	// 		if act.failFn != nil {
-	// 			act.failFn(na.nodeName, act.key, act.origVal)
-	// 		}
-	// 	}
-	// }
+// flattenActions turns an action map into key -> (string value or nil for
+// delete), without checking against any existing object.
+func flattenActions(changes map[string]*action) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for k, act := range changes {
+		if act.origVal != nil {
+			patch[k] = act.val
+		} else {
+			patch[k] = nil
+		}
+	}
+	return patch
+}
 
-	return err
+// Object is the constraint satisfied by API objects the generic Annotator
+// can patch: standard object metadata plus DeepCopyObject, which covers
+// every built-in API type and any CRD generated with the usual codegen.
+type Object interface {
+	metav1.Object
+	runtime.Object
 }
 
-// NewPodAnnotator returns a new annotator for Pod objects
-func NewPodAnnotator(kube Interface, podName string, namespace string) Annotator {
-	return &podAnnotator{
-		kube:      kube,
-		podName:   podName,
-		namespace: namespace,
-		changes:   make(map[string]interface{}),
-	}
+// Patcher abstracts the apiserver/informer calls the generic Annotator needs
+// for one kind of object. Implementations: NodePatcher, PodPatcher,
+// NamespacePatcher, plus room for arbitrary CRDs that ovn-kubernetes manages
+// (EgressIP, EgressFirewall, ...).
+type Patcher[T Object] interface {
+	// Get returns the current object, ideally from a shared informer cache.
+	Get(namespace, name string) (T, error)
+	// Patch submits patchData against the apiserver.
+	Patch(namespace, name string, patchData []byte, patchType types.PatchType) error
 }
 
-type podAnnotator struct {
-	kube      Interface
-	podName   string
+// genericAnnotator is the sole Annotator implementation. It replaces the
+// former nodeAnnotator, podAnnotator, and namespaceAnnotator, which differed
+// only in the target kind and the Patcher used to read/write it.
+type genericAnnotator[T Object] struct {
+	patcher   Patcher[T]
+	kind      string
 	namespace string
+	name      string
+	opts      patchOptions
 
-	changes map[string]interface{}
+	changes      map[string]*action
+	labelChanges map[string]*action
 	sync.Mutex
 }
 
-func (pa *podAnnotator) Set(key string, val interface{}) error {
-	return pa.SetWithFailureHandler(key, val, nil)
+// NewGenericAnnotator returns an Annotator for any object kind that has a
+// Patcher, including CRDs outside this package.
+func NewGenericAnnotator[T Object](kind string, patcher Patcher[T], namespace, name string, opts ...AnnotatorOption) Annotator {
+	return &genericAnnotator[T]{
+		patcher:      patcher,
+		kind:         kind,
+		namespace:    namespace,
+		name:         name,
+		opts:         newPatchOptions(opts...),
+		changes:      make(map[string]*action),
+		labelChanges: make(map[string]*action),
+	}
 }
 
-func (pa *podAnnotator) SetWithFailureHandler(key string, val interface{}, failFn FailureHandlerFn) error {
-	pa.Lock()
-	defer pa.Unlock()
+func (ga *genericAnnotator[T]) Set(key string, val interface{}) error {
+	return ga.SetWithFailureHandler(key, val, nil)
+}
 
-	if val == nil {
-		pa.changes[key] = nil
-		return nil
+func (ga *genericAnnotator[T]) SetWithFailureHandler(key string, val interface{}, failFn FailureHandlerFn) error {
+	act, err := newAction(key, val, failFn)
+	if err != nil {
+		return err
 	}
+	ga.Lock()
+	defer ga.Unlock()
+	ga.changes[key] = act
+	return nil
+}
 
-	// Annotations must be either a valid string value or nil; coerce
-	// any non-empty values to string
-	if reflect.TypeOf(val).Kind() == reflect.String {
-		pa.changes[key] = val.(string)
-	} else {
-		bytes, err := json.Marshal(val)
-		if err != nil {
-			return fmt.Errorf("failed to marshal %q value %v to string: %v", key, val, err)
-		}
-		pa.changes[key] = string(bytes)
-	}
+func (ga *genericAnnotator[T]) Delete(key string) {
+	ga.Lock()
+	defer ga.Unlock()
+	ga.changes[key] = &action{key: key}
+}
+
+func (ga *genericAnnotator[T]) SetLabels(key string, val interface{}) error {
+	return ga.SetLabelsWithFailureHandler(key, val, nil)
+}
 
+func (ga *genericAnnotator[T]) SetLabelsWithFailureHandler(key string, val interface{}, failFn FailureHandlerFn) error {
+	act, err := newAction(key, val, failFn)
+	if err != nil {
+		return err
+	}
+	ga.Lock()
+	defer ga.Unlock()
+	ga.labelChanges[key] = act
 	return nil
 }
 
-func (pa *podAnnotator) Delete(key string) {
-	pa.Lock()
-	defer pa.Unlock()
-	pa.changes[key] = nil
+func (ga *genericAnnotator[T]) DeleteLabel(key string) {
+	ga.Lock()
+	defer ga.Unlock()
+	ga.labelChanges[key] = &action{key: key}
+}
+
+func (ga *genericAnnotator[T]) targetKey() targetKey {
+	return targetKey{kind: ga.kind, namespace: ga.namespace, name: ga.name}
 }
 
-func (pa *podAnnotator) Run() error {
-	pa.Lock()
-	defer pa.Unlock()
+func (ga *genericAnnotator[T]) Run() error {
+	ga.Lock()
+	defer ga.Unlock()
+	if len(ga.changes) == 0 && len(ga.labelChanges) == 0 {
+		return nil
+	}
+
+	if ga.opts.dryRun {
+		ga.changes = make(map[string]*action)
+		ga.labelChanges = make(map[string]*action)
+		return nil
+	}
 
-	if len(pa.changes) == 0 {
+	if ga.opts.batcher != nil {
+		// Pass the actions themselves, not flattened values, so a batched
+		// flush failure can still invoke each key's failFn.
+		ga.opts.batcher.enqueue(ga.targetKey(), ga.changes, ga.labelChanges, ga.opts.patchType, func(patchData []byte, patchType types.PatchType) error {
+			return ga.patcher.Patch(ga.namespace, ga.name, patchData, patchType)
+		})
+		ga.changes = make(map[string]*action)
+		ga.labelChanges = make(map[string]*action)
 		return nil
 	}
 
-	err := pa.kube.SetAnnotationsOnPod(pa.namespace, pa.podName, pa.changes)
+	obj, err := ga.patcher.Get(ga.namespace, ga.name)
+	if err != nil {
+		return err
+	}
 
-	// TODO(flaviof): need to resolve this conflict still
-	// if err != nil {
-	// 	// Let failure handlers clean up
-	// 	for _, act := range pa.changes {
-	// 		if act.failFn != nil {
-	// 			act.failFn(pa.pod, act.key, act.origVal)
-	// 		}
-	// 	}
-	// }
+	patchData, err := ga.buildPatch(obj)
+	if err != nil {
+		return err
+	}
+	if len(patchData) == 0 || string(patchData) == "{}" {
+		// Desired annotations/labels already match the cluster; skip the write.
+		ga.changes = make(map[string]*action)
+		ga.labelChanges = make(map[string]*action)
+		return nil
+	}
 
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		return ga.patcher.Patch(ga.namespace, ga.name, patchData, ga.opts.patchType)
+	})
+	if err != nil {
+		// Let failure handlers clean up, passing the freshly-fetched object so
+		// they can inspect current state before rolling back their caches.
+		for _, act := range ga.changes {
+			if act.failFn != nil {
+				act.failFn(obj, act.key, act.origVal)
+			}
+		}
+		for _, act := range ga.labelChanges {
+			if act.failFn != nil {
+				act.failFn(obj, act.key, act.origVal)
+			}
+		}
+	}
 	return err
 }
 
-// NewNamespaceAnnotator returns a new annotator for Namespace objects
-func NewNamespaceAnnotator(kube Interface, namespace *kapi.Namespace) Annotator {
-	return &namespaceAnnotator{
-		kube:      kube,
-		namespace: namespace,
-		changes:   make(map[string]*action),
+// buildPatch produces the patch body matching ga.opts.patchType: a
+// metadata-only JSON merge patch (the default), or, when WithPatchType
+// selected types.StrategicMergePatchType, the strategic-merge patch between
+// obj and obj with the pending changes applied. Must be called with ga's
+// lock held.
+func (ga *genericAnnotator[T]) buildPatch(obj T) ([]byte, error) {
+	if ga.opts.patchType != types.StrategicMergePatchType {
+		return buildMetaPatch(flattenActions(ga.changes), flattenActions(ga.labelChanges))
+	}
+	currentBytes, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
 	}
+	desiredBytes, err := json.Marshal(applyActions(obj, ga.changes, ga.labelChanges))
+	if err != nil {
+		return nil, err
+	}
+	return strategicpatch.CreateTwoWayMergePatch(currentBytes, desiredBytes, obj)
 }
 
-type namespaceAnnotator struct {
-	kube      Interface
-	namespace *kapi.Namespace
-
-	changes map[string]*action
-	sync.Mutex
+func (ga *genericAnnotator[T]) Flush(ctx context.Context) error {
+	if ga.opts.batcher == nil {
+		return nil
+	}
+	return ga.opts.batcher.flushTarget(ctx, ga.targetKey())
 }
 
-func (na *namespaceAnnotator) Set(key string, val interface{}) error {
-	return na.SetWithFailureHandler(key, val, nil)
+func (ga *genericAnnotator[T]) Local(obj runtime.Object) (runtime.Object, error) {
+	typed, ok := obj.(T)
+	if !ok {
+		return nil, fmt.Errorf("%s annotator cannot apply changes to %T", ga.kind, obj)
+	}
+	ga.Lock()
+	defer ga.Unlock()
+	return applyActions(typed, ga.changes, ga.labelChanges), nil
 }
 
-func (na *namespaceAnnotator) SetWithFailureHandler(key string, val interface{}, failFn FailureHandlerFn) error {
-	act := &action{
-		key:     key,
-		origVal: val,
-		failFn:  failFn,
-	}
-	if val != nil {
-		// Annotations must be either a valid string value or nil; coerce
-		// any non-empty values to string
-		if reflect.TypeOf(val).Kind() == reflect.String {
-			act.val = val.(string)
-		} else {
-			bytes, err := json.Marshal(val)
-			if err != nil {
-				return fmt.Errorf("failed to marshal %q value %v to string: %v", key, val, err)
-			}
-			act.val = string(bytes)
-		}
+func (ga *genericAnnotator[T]) Diff() ([]byte, error) {
+	ga.Lock()
+	defer ga.Unlock()
+	obj, err := ga.patcher.Get(ga.namespace, ga.name)
+	if err != nil {
+		return nil, err
 	}
-	na.Lock()
-	defer na.Unlock()
-	na.changes[key] = act
-	return nil
+	return ga.buildPatch(obj)
 }
 
-func (na *namespaceAnnotator) Delete(key string) {
-	na.Lock()
-	defer na.Unlock()
-	na.changes[key] = &action{key: key}
-}
-
-func (na *namespaceAnnotator) Run() error {
-	annotations := make(map[string]interface{})
-	na.Lock()
-	defer na.Unlock()
-	for k, act := range na.changes {
-		// Ignore annotations that already exist with the same value
-		if existing, ok := na.namespace.Annotations[k]; existing != act.val || !ok {
-			if act.origVal != nil {
-				// Annotation should be updated to new value
-				annotations[k] = act.val
-			} else {
-				// Annotation should be deleted
-				annotations[k] = ""
-			}
-		}
+// applyActions returns a deep copy of obj with the pending annotation/label
+// changes applied.
+func applyActions[T Object](obj T, changes, labelChanges map[string]*action) T {
+	out := obj.DeepCopyObject().(T)
+
+	annotations := out.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
 	}
-	if len(annotations) == 0 {
-		return nil
+	mergeActionsInto(annotations, changes)
+	out.SetAnnotations(annotations)
+
+	labels := out.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
 	}
+	mergeActionsInto(labels, labelChanges)
+	out.SetLabels(labels)
 
-	err := na.kube.SetAnnotationsOnNamespace(na.namespace.Name, annotations)
-	if err != nil {
-		// Let failure handlers clean up
-		for _, act := range na.changes {
-			if act.failFn != nil {
-				act.failFn(na.namespace, act.key, act.origVal)
-			}
+	return out
+}
+
+func mergeActionsInto(m map[string]string, changes map[string]*action) {
+	for k, act := range changes {
+		if act.origVal == nil {
+			delete(m, k)
+		} else {
+			m[k] = act.val
 		}
 	}
-	return err
+}
+
+// NewNodeAnnotator returns a new annotator for Node objects
+func NewNodeAnnotator(kube Interface, nodeName string, opts ...AnnotatorOption) Annotator {
+	return NewGenericAnnotator[*kapi.Node]("Node", &NodePatcher{Kube: kube}, "", nodeName, opts...)
+}
+
+// NewNodeAnnotatorFromLister is like NewNodeAnnotator, but has Run() consult
+// the given informer lister instead of issuing a live Get against the
+// apiserver.
+func NewNodeAnnotatorFromLister(kube Interface, lister corelisters.NodeLister, nodeName string, opts ...AnnotatorOption) Annotator {
+	return NewGenericAnnotator[*kapi.Node]("Node", &NodePatcher{Kube: kube, Lister: lister}, "", nodeName, opts...)
+}
+
+// NewPodAnnotator returns a new annotator for Pod objects
+func NewPodAnnotator(kube Interface, podName string, namespace string, opts ...AnnotatorOption) Annotator {
+	return NewGenericAnnotator[*kapi.Pod]("Pod", &PodPatcher{Kube: kube}, namespace, podName, opts...)
+}
+
+// NewPodAnnotatorFromLister is like NewPodAnnotator, but has Run() consult
+// the given informer lister instead of issuing a live Get against the
+// apiserver.
+func NewPodAnnotatorFromLister(kube Interface, lister corelisters.PodLister, podName string, namespace string, opts ...AnnotatorOption) Annotator {
+	return NewGenericAnnotator[*kapi.Pod]("Pod", &PodPatcher{Kube: kube, Lister: lister}, namespace, podName, opts...)
+}
+
+// NewNamespaceAnnotator returns a new annotator for Namespace objects
+func NewNamespaceAnnotator(kube Interface, namespace *kapi.Namespace, opts ...AnnotatorOption) Annotator {
+	return NewGenericAnnotator[*kapi.Namespace]("Namespace", &NamespacePatcher{Kube: kube}, "", namespace.Name, opts...)
+}
+
+// NewNamespaceAnnotatorFromLister is like NewNamespaceAnnotator, but has
+// Run() consult the given informer lister instead of issuing a live Get
+// against the apiserver.
+func NewNamespaceAnnotatorFromLister(kube Interface, lister corelisters.NamespaceLister, namespace *kapi.Namespace, opts ...AnnotatorOption) Annotator {
+	return NewGenericAnnotator[*kapi.Namespace]("Namespace", &NamespacePatcher{Kube: kube, Lister: lister}, "", namespace.Name, opts...)
 }
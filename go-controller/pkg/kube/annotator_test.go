@@ -0,0 +1,189 @@
+package kube
+
+import (
+	"strings"
+	"testing"
+
+	kapi "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeNodePatcher is a Patcher[*kapi.Node] backed by an in-memory node, with
+// no apiserver involved.
+type fakeNodePatcher struct {
+	node *kapi.Node
+}
+
+func (p *fakeNodePatcher) Get(_, _ string) (*kapi.Node, error) {
+	return p.node, nil
+}
+
+func (p *fakeNodePatcher) Patch(_, _ string, _ []byte, _ types.PatchType) error {
+	return nil
+}
+
+func newTestNode() *kapi.Node {
+	return &kapi.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node1",
+			Annotations: map[string]string{
+				"existing": "value",
+			},
+			Labels: map[string]string{
+				"existing-label": "value",
+			},
+		},
+	}
+}
+
+func TestGenericAnnotatorLocal(t *testing.T) {
+	node := newTestNode()
+	a := NewGenericAnnotator[*kapi.Node]("Node", &fakeNodePatcher{node: node}, "", node.Name)
+
+	if err := a.Set("new-key", "new-value"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := a.SetLabels("new-label", "label-value"); err != nil {
+		t.Fatalf("SetLabels: %v", err)
+	}
+	a.Delete("existing")
+
+	out, err := a.Local(node)
+	if err != nil {
+		t.Fatalf("Local: %v", err)
+	}
+	localNode := out.(*kapi.Node)
+
+	if v, ok := localNode.Annotations["new-key"]; !ok || v != "new-value" {
+		t.Errorf("expected new-key=new-value, got %q, ok=%v", v, ok)
+	}
+	if _, ok := localNode.Annotations["existing"]; ok {
+		t.Errorf("expected existing annotation to be deleted, still present")
+	}
+	if v, ok := localNode.Labels["new-label"]; !ok || v != "label-value" {
+		t.Errorf("expected new-label=label-value, got %q, ok=%v", v, ok)
+	}
+
+	// Local must not mutate the object it was given.
+	if _, ok := node.Annotations["existing"]; !ok {
+		t.Errorf("Local mutated the input object's annotations")
+	}
+	if _, ok := node.Annotations["new-key"]; ok {
+		t.Errorf("Local mutated the input object's annotations")
+	}
+}
+
+// erroringNodePatcher always fails Patch with patchErr, recording each
+// attempt.
+type erroringNodePatcher struct {
+	node     *kapi.Node
+	patchErr error
+	calls    int
+}
+
+func (p *erroringNodePatcher) Get(_, _ string) (*kapi.Node, error) {
+	return p.node, nil
+}
+
+func (p *erroringNodePatcher) Patch(_, _ string, _ []byte, _ types.PatchType) error {
+	p.calls++
+	return p.patchErr
+}
+
+func TestGenericAnnotatorRunInvokesFailureHandler(t *testing.T) {
+	node := newTestNode()
+	patcher := &erroringNodePatcher{node: node, patchErr: apierrors.NewForbidden(schema.GroupResource{Resource: "nodes"}, node.Name, nil)}
+	a := NewGenericAnnotator[*kapi.Node]("Node", patcher, "", node.Name)
+
+	var gotObj interface{}
+	var gotKey string
+	var gotVal interface{}
+	called := 0
+	failFn := func(obj interface{}, key string, val interface{}) {
+		called++
+		gotObj, gotKey, gotVal = obj, key, val
+	}
+
+	if err := a.SetWithFailureHandler("new-key", "new-value", failFn); err != nil {
+		t.Fatalf("SetWithFailureHandler: %v", err)
+	}
+
+	err := a.Run()
+	if err == nil {
+		t.Fatal("expected Run to surface the Patch error")
+	}
+	if called != 1 {
+		t.Fatalf("expected failFn to be invoked once, got %d", called)
+	}
+	if gotObj != node {
+		t.Errorf("expected failFn to receive the freshly-fetched node, got %v", gotObj)
+	}
+	if gotKey != "new-key" {
+		t.Errorf("expected failFn key new-key, got %q", gotKey)
+	}
+	if gotVal != "new-value" {
+		t.Errorf("expected failFn origVal new-value, got %v", gotVal)
+	}
+}
+
+func TestGenericAnnotatorLocalWrongType(t *testing.T) {
+	node := newTestNode()
+	a := NewGenericAnnotator[*kapi.Node]("Node", &fakeNodePatcher{node: node}, "", node.Name)
+
+	if _, err := a.Local(&kapi.Pod{}); err == nil {
+		t.Fatal("expected an error when Local is given the wrong concrete type")
+	}
+}
+
+func TestGenericAnnotatorDiff(t *testing.T) {
+	node := newTestNode()
+	a := NewGenericAnnotator[*kapi.Node]("Node", &fakeNodePatcher{node: node}, "", node.Name)
+
+	if err := a.Set("new-key", "new-value"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	patch, err := a.Diff()
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if !strings.Contains(string(patch), "new-key") {
+		t.Errorf("expected diff to mention new-key, got %s", patch)
+	}
+}
+
+func TestGenericAnnotatorDiffNoChanges(t *testing.T) {
+	node := newTestNode()
+	a := NewGenericAnnotator[*kapi.Node]("Node", &fakeNodePatcher{node: node}, "", node.Name)
+
+	patch, err := a.Diff()
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	// The default patch type is a metadata-only JSON merge patch, which
+	// doesn't compare against the current object, so an empty change set
+	// still serializes the (empty) metadata envelope.
+	if string(patch) != `{"metadata":{}}` {
+		t.Errorf("expected an empty-metadata patch with no pending changes, got %s", patch)
+	}
+}
+
+func TestGenericAnnotatorDiffStrategicMergePatchType(t *testing.T) {
+	node := newTestNode()
+	a := NewGenericAnnotator[*kapi.Node]("Node", &fakeNodePatcher{node: node}, "", node.Name, WithPatchType(types.StrategicMergePatchType))
+
+	if err := a.Set("new-key", "new-value"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	patch, err := a.Diff()
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if !strings.Contains(string(patch), "new-key") {
+		t.Errorf("expected diff to mention new-key, got %s", patch)
+	}
+}
@@ -0,0 +1,371 @@
+package kube
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// DefaultDebounce is how long a target's patcher waits for more Set/Delete
+	// calls to arrive before flushing them as a single patch.
+	DefaultDebounce = 100 * time.Millisecond
+)
+
+var (
+	annotationsBatchedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "annotations_batched_total",
+		Help: "Number of annotation/label key changes coalesced into patches by the AnnotationBatcher.",
+	})
+	annotationFlushLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "annotation_flush_latency_seconds",
+		Help:    "Latency of AnnotationBatcher patch flushes against the apiserver.",
+		Buckets: prometheus.DefBuckets,
+	})
+	annotationConflictsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "annotation_conflicts_total",
+		Help: "Number of apiserver conflicts (409) encountered while flushing batched annotation patches.",
+	})
+)
+
+// targetKey identifies the single object a batchTarget accumulates changes for.
+type targetKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// patchFn submits patchData against the apiserver for one target.
+type patchFn func(patchData []byte, patchType types.PatchType) error
+
+// AnnotationBatcher coalesces Set/Delete calls arriving for the same
+// (kind, namespace, name) target within a debounce window into a single
+// patch, so a busy node doesn't produce one PATCH per pod churn event.
+type AnnotationBatcher struct {
+	debounce time.Duration
+
+	mu      sync.Mutex
+	targets map[targetKey]*batchTarget
+}
+
+// NewAnnotationBatcher returns a batcher that flushes coalesced changes for
+// a target debounce after its last enqueued change.
+func NewAnnotationBatcher(debounce time.Duration) *AnnotationBatcher {
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	return &AnnotationBatcher{
+		debounce: debounce,
+		targets:  make(map[targetKey]*batchTarget),
+	}
+}
+
+// enqueue merges annotations/labels into the pending changes for key and
+// (re)arms its debounce timer. It never blocks on the apiserver.
+func (b *AnnotationBatcher) enqueue(key targetKey, annotations, labels map[string]*action, patchType types.PatchType, patch patchFn) {
+	b.mu.Lock()
+	t, ok := b.targets[key]
+	if !ok {
+		t = newBatchTarget(b, key, patch)
+		b.targets[key] = t
+	}
+	b.mu.Unlock()
+
+	t.merge(annotations, labels, patchType)
+}
+
+// Forget drops any pending changes and stops tracking the given target, e.g.
+// because its caller already knows the underlying object was deleted. A
+// target that hits a non-conflict error on its own evicts itself, but callers
+// that learn about a deletion up front don't have to wait for that round
+// trip.
+func (b *AnnotationBatcher) Forget(kind, namespace, name string) {
+	b.evict(targetKey{kind: kind, namespace: namespace, name: name})
+}
+
+func (b *AnnotationBatcher) evict(key targetKey) {
+	b.mu.Lock()
+	t, ok := b.targets[key]
+	if ok {
+		delete(b.targets, key)
+	}
+	b.mu.Unlock()
+	if ok {
+		t.stop()
+	}
+}
+
+// flushTarget forces an immediate flush of one target and waits for it.
+func (b *AnnotationBatcher) flushTarget(ctx context.Context, key targetKey) error {
+	b.mu.Lock()
+	t, ok := b.targets[key]
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return t.flushAndWait(ctx)
+}
+
+// Flush waits for every target with pending or in-flight changes to settle.
+func (b *AnnotationBatcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	targets := make([]*batchTarget, 0, len(b.targets))
+	for _, t := range b.targets {
+		targets = append(targets, t)
+	}
+	b.mu.Unlock()
+
+	for _, t := range targets {
+		if err := t.flushAndWait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchTarget accumulates changes for a single object and owns the one
+// flush() invocation at a time responsible for debouncing and flushing them.
+type batchTarget struct {
+	batcher *AnnotationBatcher
+	key     targetKey
+	patch   patchFn
+
+	mu          sync.Mutex
+	annotations map[string]*action
+	labels      map[string]*action
+	patchType   types.PatchType
+	timer       *time.Timer
+	debounce    time.Duration
+	rateLimiter workqueue.RateLimiter
+	waiters     []chan error
+	flushing    bool
+	stopped     bool
+}
+
+func newBatchTarget(batcher *AnnotationBatcher, key targetKey, patch patchFn) *batchTarget {
+	return &batchTarget{
+		batcher:     batcher,
+		key:         key,
+		patch:       patch,
+		annotations: make(map[string]*action),
+		labels:      make(map[string]*action),
+		patchType:   types.MergePatchType,
+		debounce:    batcher.debounce,
+		rateLimiter: workqueue.NewItemExponentialFailureRateLimiter(500*time.Millisecond, 30*time.Second),
+	}
+}
+
+func (t *batchTarget) merge(annotations, labels map[string]*action, patchType types.PatchType) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+
+	for k, act := range annotations {
+		t.annotations[k] = act
+		annotationsBatchedTotal.Inc()
+	}
+	for k, act := range labels {
+		t.labels[k] = act
+		annotationsBatchedTotal.Inc()
+	}
+	t.patchType = patchType
+
+	if t.flushing {
+		// A flush is already in flight; once it completes it arms a
+		// fresh timer for this data itself (debounce on success, backoff
+		// on conflict). On any other error the target is evicted and this
+		// data is dropped.
+		return
+	}
+
+	if t.timer == nil {
+		t.timer = time.AfterFunc(t.debounce, t.flush)
+	} else {
+		t.timer.Reset(t.debounce)
+	}
+}
+
+// stop abandons any pending timer and wakes up any Flush waiters with nil,
+// since the target (and whatever it pointed at) no longer exists as far as
+// this batcher is concerned.
+func (t *batchTarget) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	waiters := t.waiters
+	t.waiters = nil
+	t.mu.Unlock()
+	notifyWaiters(waiters, nil)
+}
+
+// flush builds and submits the patch accumulated so far. Only one flush runs
+// at a time per target, guarded by the flushing flag rather than by the
+// timer's nilness, since a debounce timer firing, a retry reschedule, and a
+// flushAndWait caller can all try to start one concurrently. On a conflict it
+// requeues with workqueue-style exponential backoff instead of dropping the
+// change. Any other error (NotFound, a rejected value, permission denied,
+// ...) will never succeed on retry, so the pending failure handlers are
+// invoked, any Flush waiters are woken with the real error, and the target is
+// evicted from the batcher instead of being retried forever.
+func (t *batchTarget) flush() {
+	t.mu.Lock()
+	if t.stopped || t.flushing {
+		t.mu.Unlock()
+		return
+	}
+	if len(t.annotations) == 0 && len(t.labels) == 0 {
+		t.timer = nil
+		waiters := t.waiters
+		t.waiters = nil
+		t.mu.Unlock()
+		notifyWaiters(waiters, nil)
+		return
+	}
+	patchData, err := buildMetaPatch(flattenActions(t.annotations), flattenActions(t.labels))
+	annotations, labels, patchType := t.annotations, t.labels, t.patchType
+	t.annotations = make(map[string]*action)
+	t.labels = make(map[string]*action)
+	t.flushing = true
+	t.timer = nil
+	t.mu.Unlock()
+
+	if err != nil {
+		t.finishTerminal(err, annotations, labels)
+		return
+	}
+
+	start := time.Now()
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		perr := t.patch(patchData, patchType)
+		if apierrors.IsConflict(perr) {
+			annotationConflictsTotal.Inc()
+		}
+		return perr
+	})
+	annotationFlushLatency.Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		t.rateLimiter.Forget(t)
+		t.finishSuccess()
+		return
+	}
+
+	if !apierrors.IsConflict(err) {
+		t.finishTerminal(err, annotations, labels)
+		return
+	}
+
+	// RetryOnConflict exhausted its own retries; requeue with
+	// workqueue-style exponential backoff on top of that, instead of
+	// dropping the change.
+	t.mu.Lock()
+	t.flushing = false
+	if !t.stopped {
+		for k, act := range annotations {
+			if _, ok := t.annotations[k]; !ok {
+				t.annotations[k] = act
+			}
+		}
+		for k, act := range labels {
+			if _, ok := t.labels[k]; !ok {
+				t.labels[k] = act
+			}
+		}
+		t.timer = time.AfterFunc(t.rateLimiter.When(t), t.flush)
+	}
+	t.mu.Unlock()
+}
+
+// finishSuccess clears the in-flight flag and, if more changes were merged
+// in while this flush was in flight, arms a fresh debounce timer for them.
+func (t *batchTarget) finishSuccess() {
+	t.mu.Lock()
+	t.flushing = false
+	if !t.stopped && (len(t.annotations) > 0 || len(t.labels) > 0) {
+		t.timer = time.AfterFunc(t.debounce, t.flush)
+	}
+	waiters := t.waiters
+	t.waiters = nil
+	t.mu.Unlock()
+	notifyWaiters(waiters, nil)
+}
+
+// finishTerminal invokes failure handlers for a flush that can never succeed
+// on retry, wakes any Flush waiters with the real error, and evicts the
+// target so nothing keeps retrying a write that's doomed to fail the same way.
+func (t *batchTarget) finishTerminal(err error, annotations, labels map[string]*action) {
+	runBatchedFailureHandlers(t.key, annotations, labels)
+	t.mu.Lock()
+	t.flushing = false
+	waiters := t.waiters
+	t.waiters = nil
+	t.mu.Unlock()
+	notifyWaiters(waiters, err)
+	t.batcher.evict(t.key)
+}
+
+// runBatchedFailureHandlers invokes each action's failFn, passing the
+// target's identity since the object that failed to patch can no longer be
+// fetched.
+func runBatchedFailureHandlers(key targetKey, annotations, labels map[string]*action) {
+	for _, act := range annotations {
+		if act.failFn != nil {
+			act.failFn(key, act.key, act.origVal)
+		}
+	}
+	for _, act := range labels {
+		if act.failFn != nil {
+			act.failFn(key, act.key, act.origVal)
+		}
+	}
+}
+
+// flushAndWait forces an immediate flush (if one isn't already in flight or
+// pending) and blocks until it, and any retry it spawns, settles.
+func (t *batchTarget) flushAndWait(ctx context.Context) error {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return nil
+	}
+	if !t.flushing && len(t.annotations) == 0 && len(t.labels) == 0 && t.timer == nil {
+		t.mu.Unlock()
+		return nil
+	}
+	done := make(chan error, 1)
+	t.waiters = append(t.waiters, done)
+	if !t.flushing {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		t.timer = time.AfterFunc(0, t.flush)
+	}
+	t.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func notifyWaiters(waiters []chan error, err error) {
+	for _, w := range waiters {
+		w <- err
+		close(w)
+	}
+}
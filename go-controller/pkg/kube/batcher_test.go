@@ -0,0 +1,135 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestAnnotationBatcherEvictsOnNotFound(t *testing.T) {
+	b := NewAnnotationBatcher(time.Millisecond)
+	key := targetKey{kind: "Node", name: "node1"}
+
+	patch := func(_ []byte, _ types.PatchType) error {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "nodes"}, "node1")
+	}
+
+	var mu sync.Mutex
+	var failedKeys []string
+	failFn := func(_ interface{}, failKey string, _ interface{}) {
+		mu.Lock()
+		failedKeys = append(failedKeys, failKey)
+		mu.Unlock()
+	}
+
+	act, err := newAction("gone", "value", failFn)
+	if err != nil {
+		t.Fatalf("newAction: %v", err)
+	}
+	b.enqueue(key, map[string]*action{"gone": act}, nil, types.MergePatchType, patch)
+
+	if err := b.Flush(context.Background()); err == nil || !apierrors.IsNotFound(err) {
+		t.Fatalf("expected Flush to surface the NotFound error, got %v", err)
+	}
+
+	mu.Lock()
+	got := append([]string(nil), failedKeys...)
+	mu.Unlock()
+	if len(got) != 1 || got[0] != "gone" {
+		t.Errorf("expected failFn to be invoked once for key %q, got %v", "gone", got)
+	}
+
+	b.mu.Lock()
+	_, stillTracked := b.targets[key]
+	b.mu.Unlock()
+	if stillTracked {
+		t.Errorf("expected target to be evicted after a NotFound flush")
+	}
+
+	// A second Flush should be a no-op now that the target is gone, not
+	// retry the deleted object forever.
+	if err := b.Flush(context.Background()); err != nil {
+		t.Errorf("expected Flush on an evicted target to be a no-op, got %v", err)
+	}
+}
+
+func TestAnnotationBatcherCoalescesWithinDebounce(t *testing.T) {
+	b := NewAnnotationBatcher(50 * time.Millisecond)
+	key := targetKey{kind: "Node", name: "node1"}
+
+	var mu sync.Mutex
+	var patchCount int
+	var lastAnnotations map[string]interface{}
+	patch := func(patchData []byte, _ types.PatchType) error {
+		mu.Lock()
+		patchCount++
+		mu.Unlock()
+		var got metaPatch
+		if err := json.Unmarshal(patchData, &got); err != nil {
+			t.Fatalf("unmarshal patch: %v", err)
+		}
+		annotations := make(map[string]interface{}, len(got.Metadata.Annotations))
+		for k, v := range got.Metadata.Annotations {
+			if v == nil {
+				annotations[k] = nil
+			} else {
+				annotations[k] = *v
+			}
+		}
+		mu.Lock()
+		lastAnnotations = annotations
+		mu.Unlock()
+		return nil
+	}
+
+	for i, v := range []string{"v1", "v2", "v3"} {
+		act, err := newAction("key", v, nil)
+		if err != nil {
+			t.Fatalf("newAction %d: %v", i, err)
+		}
+		b.enqueue(key, map[string]*action{"key": act}, nil, types.MergePatchType, patch)
+	}
+
+	if err := b.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if patchCount != 1 {
+		t.Errorf("expected the three enqueued changes to collapse into a single patch, got %d patch calls", patchCount)
+	}
+	if lastAnnotations["key"] != "v3" {
+		t.Errorf("expected the coalesced patch to carry the latest value v3, got %v", lastAnnotations["key"])
+	}
+}
+
+func TestAnnotationBatcherForget(t *testing.T) {
+	b := NewAnnotationBatcher(time.Hour)
+	key := targetKey{kind: "Pod", namespace: "ns", name: "pod1"}
+
+	patch := func(_ []byte, _ types.PatchType) error {
+		t.Fatalf("patch should never be called once the target is forgotten")
+		return nil
+	}
+
+	act, err := newAction("k", "v", nil)
+	if err != nil {
+		t.Fatalf("newAction: %v", err)
+	}
+	b.enqueue(key, map[string]*action{"k": act}, nil, types.MergePatchType, patch)
+	b.Forget(key.kind, key.namespace, key.name)
+
+	b.mu.Lock()
+	_, stillTracked := b.targets[key]
+	b.mu.Unlock()
+	if stillTracked {
+		t.Errorf("expected Forget to remove the target")
+	}
+}
@@ -0,0 +1,59 @@
+package kube
+
+import (
+	"context"
+
+	kapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Interface represents the exported methods for dealing with getting/setting
+// kubernetes resources
+type Interface interface {
+	PatchNode(nodeName string, patchData []byte, patchType types.PatchType) error
+	PatchPod(namespace, podName string, patchData []byte, patchType types.PatchType) error
+	PatchNamespace(namespace string, patchData []byte, patchType types.PatchType) error
+	GetNode(nodeName string) (*kapi.Node, error)
+	GetPod(namespace, podName string) (*kapi.Pod, error)
+	GetNamespace(namespace string) (*kapi.Namespace, error)
+}
+
+// Kube is the structure object upon which the Interface is implemented
+type Kube struct {
+	KClient kubernetes.Interface
+}
+
+// PatchNode patches the given node with the given patch data
+func (k *Kube) PatchNode(nodeName string, patchData []byte, patchType types.PatchType) error {
+	_, err := k.KClient.CoreV1().Nodes().Patch(context.TODO(), nodeName, patchType, patchData, metav1.PatchOptions{})
+	return err
+}
+
+// PatchPod patches the given pod with the given patch data
+func (k *Kube) PatchPod(namespace, podName string, patchData []byte, patchType types.PatchType) error {
+	_, err := k.KClient.CoreV1().Pods(namespace).Patch(context.TODO(), podName, patchType, patchData, metav1.PatchOptions{})
+	return err
+}
+
+// PatchNamespace patches the given namespace with the given patch data
+func (k *Kube) PatchNamespace(namespace string, patchData []byte, patchType types.PatchType) error {
+	_, err := k.KClient.CoreV1().Namespaces().Patch(context.TODO(), namespace, patchType, patchData, metav1.PatchOptions{})
+	return err
+}
+
+// GetNode returns the Node with the given name
+func (k *Kube) GetNode(nodeName string) (*kapi.Node, error) {
+	return k.KClient.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+}
+
+// GetPod returns the Pod with the given namespace and name
+func (k *Kube) GetPod(namespace, podName string) (*kapi.Pod, error) {
+	return k.KClient.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
+}
+
+// GetNamespace returns the Namespace with the given name
+func (k *Kube) GetNamespace(namespace string) (*kapi.Namespace, error) {
+	return k.KClient.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+}
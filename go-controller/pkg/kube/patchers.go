@@ -0,0 +1,62 @@
+package kube
+
+import (
+	kapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// NodePatcher implements Patcher[*v1.Node]. Get prefers the shared informer
+// Lister when one is supplied, falling back to a live read through Kube.
+type NodePatcher struct {
+	Kube   Interface
+	Lister corelisters.NodeLister
+}
+
+func (p *NodePatcher) Get(_, name string) (*kapi.Node, error) {
+	if p.Lister != nil {
+		return p.Lister.Get(name)
+	}
+	return p.Kube.GetNode(name)
+}
+
+func (p *NodePatcher) Patch(_, name string, patchData []byte, patchType types.PatchType) error {
+	return p.Kube.PatchNode(name, patchData, patchType)
+}
+
+// PodPatcher implements Patcher[*v1.Pod]. Get prefers the shared informer
+// Lister when one is supplied, falling back to a live read through Kube.
+type PodPatcher struct {
+	Kube   Interface
+	Lister corelisters.PodLister
+}
+
+func (p *PodPatcher) Get(namespace, name string) (*kapi.Pod, error) {
+	if p.Lister != nil {
+		return p.Lister.Pods(namespace).Get(name)
+	}
+	return p.Kube.GetPod(namespace, name)
+}
+
+func (p *PodPatcher) Patch(namespace, name string, patchData []byte, patchType types.PatchType) error {
+	return p.Kube.PatchPod(namespace, name, patchData, patchType)
+}
+
+// NamespacePatcher implements Patcher[*v1.Namespace]. Get prefers the shared
+// informer Lister when one is supplied, falling back to a live read through
+// Kube.
+type NamespacePatcher struct {
+	Kube   Interface
+	Lister corelisters.NamespaceLister
+}
+
+func (p *NamespacePatcher) Get(_, name string) (*kapi.Namespace, error) {
+	if p.Lister != nil {
+		return p.Lister.Get(name)
+	}
+	return p.Kube.GetNamespace(name)
+}
+
+func (p *NamespacePatcher) Patch(_, name string, patchData []byte, patchType types.PatchType) error {
+	return p.Kube.PatchNamespace(name, patchData, patchType)
+}